@@ -0,0 +1,445 @@
+// Package browser provides a long-lived, reusable Playwright browser
+// session shared across BDD scenarios, so scenarios don't each pay the
+// cost of installing a browser engine and launching it from scratch.
+package browser
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/playwright-community/playwright-go"
+	"go.uber.org/zap"
+
+	"github.com/AlaudaDevops/bdd/logger"
+)
+
+// Config controls how a Session is provisioned and how long persisted
+// login state is trusted.
+type Config struct {
+	// Headless controls whether launched browsers run headless.
+	Headless bool
+	// StorageDir is where per-context storage_state.json files are kept.
+	StorageDir string
+	// CookieTTL is how long a persisted storage state stays valid
+	// before a scenario is forced to log in again from scratch.
+	CookieTTL time.Duration
+	// RecordVideo enables .webm video recording for every context.
+	RecordVideo bool
+	// VideoDir is where videos are written when RecordVideo is enabled.
+	VideoDir string
+	// TraceDir is where Playwright trace chunks are written.
+	TraceDir string
+}
+
+func (c *Config) setDefaults() {
+	if c.StorageDir == "" {
+		c.StorageDir = "output/storage-state"
+	}
+	if c.CookieTTL == 0 {
+		c.CookieTTL = 30 * time.Minute
+	}
+	if c.VideoDir == "" {
+		c.VideoDir = "output/videos"
+	}
+	if c.TraceDir == "" {
+		c.TraceDir = "output/traces"
+	}
+}
+
+// ContextKey identifies one reusable BrowserContext: a scenario tag
+// combined with the engine and device-emulation profile under test, so
+// the same tag can be driven through Chromium, Firefox and WebKit (and
+// through different device profiles) without the contexts colliding.
+type ContextKey struct {
+	// Tag groups scenarios that should share cookies/login state.
+	Tag string
+	// Engine is "chromium" (default), "firefox" or "webkit".
+	Engine string
+	// Device is a playwright-go device name (e.g. "iPhone 13"). Empty
+	// means no device emulation.
+	Device string
+	// Locale and TimezoneID, when set, override the context's defaults.
+	Locale     string
+	TimezoneID string
+}
+
+func (k ContextKey) id() string {
+	engine := k.Engine
+	if engine == "" {
+		engine = "chromium"
+	}
+	return fmt.Sprintf("%s_%s_%s_%s_%s", k.Tag, engine, k.Device, k.Locale, k.TimezoneID)
+}
+
+// taggedContext is the BrowserContext/Page pair kept alive for a single
+// ContextKey, plus whether it is already authenticated. Its page's
+// console messages and uncaught errors are collected here for the
+// page's whole lifetime, since the page itself outlives any one step.
+type taggedContext struct {
+	ctx           playwright.BrowserContext
+	page          playwright.Page
+	authenticated bool
+
+	logMu       sync.Mutex
+	consoleLogs []string
+	pageErrors  []string
+}
+
+// Session owns a single Playwright driver and lazily launches one
+// Browser per engine, handing out one BrowserContext/Page per
+// ContextKey and persisting each key's cookies and storage_state.json
+// between steps so an authenticated context can be reused instead of
+// logging in again.
+type Session struct {
+	cfg Config
+	pw  *playwright.Playwright
+
+	browserMu sync.Mutex
+	browsers  map[string]playwright.Browser
+
+	mu       sync.Mutex
+	contexts map[string]*taggedContext
+}
+
+// NewSession installs the supported engines (if needed) and starts the
+// Playwright driver. Browsers themselves are launched lazily, the first
+// time a scenario asks for one. Call Close once the suite finishes.
+func NewSession(ctx context.Context, cfg Config) (*Session, error) {
+	cfg.setDefaults()
+	log := logger.LoggerFromContext(ctx)
+
+	if err := playwright.Install(&playwright.RunOptions{
+		Browsers: []string{"chromium", "firefox", "webkit"},
+	}); err != nil {
+		log.Error("安装 playwright 失败", zap.Error(err))
+		return nil, err
+	}
+
+	pw, err := playwright.Run()
+	if err != nil {
+		log.Error("无法启动 playwright", zap.Error(err))
+		return nil, err
+	}
+
+	if err := os.MkdirAll(cfg.StorageDir, 0o755); err != nil {
+		pw.Stop()
+		return nil, fmt.Errorf("创建登录状态存储目录失败: %v", err)
+	}
+	if err := os.MkdirAll(cfg.TraceDir, 0o755); err != nil {
+		pw.Stop()
+		return nil, fmt.Errorf("创建 Tracing 存储目录失败: %v", err)
+	}
+	if cfg.RecordVideo {
+		if err := os.MkdirAll(cfg.VideoDir, 0o755); err != nil {
+			pw.Stop()
+			return nil, fmt.Errorf("创建视频存储目录失败: %v", err)
+		}
+	}
+
+	return &Session{
+		cfg:      cfg,
+		pw:       pw,
+		browsers: map[string]playwright.Browser{},
+		contexts: map[string]*taggedContext{},
+	}, nil
+}
+
+// Close persists every still-open authenticated context, then closes
+// every context and tears down every launched browser plus the
+// Playwright driver. Safe to call once from an AfterSuite hook.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	for id, tc := range s.contexts {
+		// Page treats a fresh storage file as a completed login, so
+		// only authenticated contexts are persisted
+		if tc.authenticated {
+			if _, err := tc.ctx.StorageState(s.storagePath(id)); err != nil {
+				// best effort: the file MarkAuthenticated wrote is kept
+				// and still expires CookieTTL after it was written
+				_ = err
+			}
+		}
+		tc.ctx.Close()
+	}
+	s.mu.Unlock()
+
+	s.browserMu.Lock()
+	for _, b := range s.browsers {
+		b.Close()
+	}
+	s.browserMu.Unlock()
+
+	if s.pw != nil {
+		return s.pw.Stop()
+	}
+	return nil
+}
+
+// Page returns the Page for the given ContextKey, launching its engine
+// and creating its BrowserContext the first time the key is seen. If a
+// storage_state.json for the key exists and is younger than the
+// configured CookieTTL, the new context restores it and the returned
+// authenticated is true, signalling that the caller can skip its login
+// flow. A cached context is likewise reported as authenticated only
+// while its storage_state.json is younger than CookieTTL.
+//
+// forceLogin discards any cached context for key, ignores its persisted
+// storage state, and always returns a freshly logged-out page. Use it for steps
+// that must observe a real login happening (e.g. asserting on the
+// network exchanges of the OIDC handshake) instead of silently reusing
+// an already-authenticated shared session.
+func (s *Session) Page(ctx context.Context, key ContextKey, forceLogin bool) (page playwright.Page, authenticated bool, err error) {
+	if key.Engine == "" {
+		key.Engine = "chromium"
+	}
+	id := key.id()
+
+	s.mu.Lock()
+	tc, ok := s.contexts[id]
+	s.mu.Unlock()
+	if ok {
+		if !forceLogin {
+			authenticated := tc.authenticated
+			if authenticated {
+				info, statErr := os.Stat(s.storagePath(id))
+				authenticated = statErr == nil && time.Since(info.ModTime()) < s.cfg.CookieTTL
+			}
+			return tc.page, authenticated, nil
+		}
+		tc.ctx.Close()
+		s.mu.Lock()
+		delete(s.contexts, id)
+		s.mu.Unlock()
+	}
+
+	b, err := s.launchEngine(key.Engine)
+	if err != nil {
+		return nil, false, err
+	}
+
+	log := logger.LoggerFromContext(ctx)
+
+	opts := playwright.BrowserNewContextOptions{
+		IgnoreHttpsErrors: playwright.Bool(true),
+	}
+	if key.Locale != "" {
+		opts.Locale = playwright.String(key.Locale)
+	}
+	if key.TimezoneID != "" {
+		opts.TimezoneId = playwright.String(key.TimezoneID)
+	}
+	if key.Device != "" {
+		device, ok := s.pw.Devices[key.Device]
+		if !ok {
+			return nil, false, fmt.Errorf("未知的设备模拟配置: %s", key.Device)
+		}
+		opts.Viewport = device.Viewport
+		opts.UserAgent = playwright.String(device.UserAgent)
+		opts.DeviceScaleFactor = playwright.Float(device.DeviceScaleFactor)
+		opts.IsMobile = playwright.Bool(device.IsMobile)
+		opts.HasTouch = playwright.Bool(device.HasTouch)
+	}
+	if s.cfg.RecordVideo {
+		opts.RecordVideo = &playwright.RecordVideo{
+			Dir: s.cfg.VideoDir,
+		}
+	}
+
+	restored := false
+	statePath := s.storagePath(id)
+	if forceLogin {
+		log.Info("强制重新登录，跳过已保存的登录状态", zap.String("key", id))
+	} else if info, statErr := os.Stat(statePath); statErr == nil {
+		if time.Since(info.ModTime()) < s.cfg.CookieTTL {
+			opts.StorageStatePath = playwright.String(statePath)
+			restored = true
+			log.Info("复用已保存的登录状态", zap.String("key", id), zap.String("path", statePath))
+		} else {
+			log.Info("已保存的登录状态已过期，重新登录", zap.String("key", id))
+		}
+	}
+
+	browserCtx, err := b.NewContext(opts)
+	if err != nil {
+		return nil, false, fmt.Errorf("创建浏览器上下文失败: %v", err)
+	}
+
+	newPage, err := browserCtx.NewPage()
+	if err != nil {
+		browserCtx.Close()
+		return nil, false, fmt.Errorf("创建新页面失败: %v", err)
+	}
+
+	if err := browserCtx.Tracing().Start(playwright.TracingStartOptions{
+		Screenshots: playwright.Bool(true),
+		Snapshots:   playwright.Bool(true),
+	}); err != nil {
+		// tracing is diagnostic-only; don't fail the run over it
+		log.Error("启动 Tracing 失败", zap.Error(err))
+	}
+
+	tc := &taggedContext{ctx: browserCtx, page: newPage, authenticated: restored}
+
+	newPage.OnConsole(func(msg playwright.ConsoleMessage) {
+		tc.logMu.Lock()
+		tc.consoleLogs = append(tc.consoleLogs, fmt.Sprintf("[%s] %s", msg.Type(), msg.Text()))
+		tc.logMu.Unlock()
+	})
+	newPage.OnPageError(func(pageErr error) {
+		tc.logMu.Lock()
+		tc.pageErrors = append(tc.pageErrors, pageErr.Error())
+		tc.logMu.Unlock()
+	})
+
+	s.mu.Lock()
+	s.contexts[id] = tc
+	s.mu.Unlock()
+
+	return tc.page, tc.authenticated, nil
+}
+
+// ConsoleLogs returns every console message observed on key's page so
+// far, formatted as "[type] text" in chronological order. The handler
+// is registered once per page in Page, so this reflects the page's
+// entire lifetime, not just the current step.
+func (s *Session) ConsoleLogs(key ContextKey) []string {
+	tc, err := s.contextFor(key)
+	if err != nil {
+		return nil
+	}
+	tc.logMu.Lock()
+	defer tc.logMu.Unlock()
+	return append([]string(nil), tc.consoleLogs...)
+}
+
+// PageErrors returns every uncaught page error observed on key's page
+// so far, in chronological order.
+func (s *Session) PageErrors(key ContextKey) []string {
+	tc, err := s.contextFor(key)
+	if err != nil {
+		return nil
+	}
+	tc.logMu.Lock()
+	defer tc.logMu.Unlock()
+	return append([]string(nil), tc.pageErrors...)
+}
+
+// TraceDir returns the directory configured for Playwright trace
+// chunks, so callers writing trace files elsewhere don't duplicate or
+// drift from the directory NewSession actually created.
+func (s *Session) TraceDir() string {
+	return s.cfg.TraceDir
+}
+
+// VideoDir returns the directory configured for recorded videos, so
+// callers writing video files elsewhere don't duplicate or drift from
+// the directory NewSession actually created.
+func (s *Session) VideoDir() string {
+	return s.cfg.VideoDir
+}
+
+// StartTraceChunk begins a new Tracing chunk for key's context, letting
+// callers capture one trace file per step instead of one per context
+// lifetime. Must be paired with StopTraceChunk.
+func (s *Session) StartTraceChunk(key ContextKey) error {
+	tc, err := s.contextFor(key)
+	if err != nil {
+		return err
+	}
+	return tc.ctx.Tracing().StartChunk()
+}
+
+// StopTraceChunk ends the current Tracing chunk for key's context and
+// writes it to path.
+func (s *Session) StopTraceChunk(key ContextKey, path string) error {
+	tc, err := s.contextFor(key)
+	if err != nil {
+		return err
+	}
+	return tc.ctx.Tracing().StopChunk(playwright.TracingStopChunkOptions{
+		Path: playwright.String(path),
+	})
+}
+
+func (s *Session) contextFor(key ContextKey) (*taggedContext, error) {
+	if key.Engine == "" {
+		key.Engine = "chromium"
+	}
+	id := key.id()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tc, ok := s.contexts[id]
+	if !ok {
+		return nil, fmt.Errorf("未知的会话标识: %s", id)
+	}
+	return tc, nil
+}
+
+// MarkAuthenticated flags key as logged in and persists its current
+// storage state so later scenarios sharing the key can skip the login
+// flow until CookieTTL elapses.
+func (s *Session) MarkAuthenticated(key ContextKey) error {
+	if key.Engine == "" {
+		key.Engine = "chromium"
+	}
+
+	tc, err := s.contextFor(key)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tc.ctx.StorageState(s.storagePath(key.id())); err != nil {
+		return fmt.Errorf("保存登录状态失败: %v", err)
+	}
+
+	s.mu.Lock()
+	tc.authenticated = true
+	s.mu.Unlock()
+	return nil
+}
+
+// launchEngine returns the shared Browser for name, launching it the
+// first time it's requested.
+func (s *Session) launchEngine(name string) (playwright.Browser, error) {
+	s.browserMu.Lock()
+	defer s.browserMu.Unlock()
+
+	if b, ok := s.browsers[name]; ok {
+		return b, nil
+	}
+
+	var bt playwright.BrowserType
+	switch name {
+	case "chromium":
+		bt = s.pw.Chromium
+	case "firefox":
+		bt = s.pw.Firefox
+	case "webkit":
+		bt = s.pw.Webkit
+	default:
+		return nil, fmt.Errorf("不支持的浏览器引擎: %s", name)
+	}
+
+	b, err := bt.Launch(playwright.BrowserTypeLaunchOptions{
+		Headless: playwright.Bool(s.cfg.Headless),
+		Args:     []string{"--ignore-certificate-errors"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("无法启动浏览器 %s: %v", name, err)
+	}
+
+	s.browsers[name] = b
+	return b, nil
+}
+
+func (s *Session) storagePath(id string) string {
+	safe := strings.NewReplacer(" ", "-", "/", "-").Replace(id)
+	return filepath.Join(s.cfg.StorageDir, fmt.Sprintf("%s-storage-state.json", safe))
+}
@@ -0,0 +1,170 @@
+// Package locator provides self-healing element lookup for Playwright
+// pages: an ordered chain of candidate selectors is walked until one
+// resolves, with exponential-backoff retries and an optional page
+// reload when every candidate keeps timing out.
+package locator
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/playwright-community/playwright-go"
+	"go.uber.org/zap"
+
+	"github.com/AlaudaDevops/bdd/logger"
+)
+
+// Candidate describes one way to find an element. Exactly one field
+// should be set; a chain can freely mix kinds, e.g. a CSS selector
+// falling back to a role+name lookup or visible text in another locale.
+type Candidate struct {
+	CSS   string `yaml:"css"`
+	XPath string `yaml:"xpath"`
+	// Role is a playwright.AriaRole value (e.g. "button"), paired with
+	// Name as the element's accessible name.
+	Role   string `yaml:"role"`
+	Name   string `yaml:"name"`
+	Text   string `yaml:"text"`
+	TestID string `yaml:"testId"`
+	// Exact requires Role/Text to match the whole accessible name/text
+	// rather than a case-insensitive substring. Defaults to false,
+	// matching Playwright's own GetByRole/GetByText default.
+	Exact bool `yaml:"exact"`
+}
+
+func (c Candidate) resolve(page playwright.Page) (playwright.Locator, error) {
+	switch {
+	case c.CSS != "":
+		return page.Locator(c.CSS), nil
+	case c.XPath != "":
+		return page.Locator(c.XPath), nil
+	case c.Role != "":
+		return page.GetByRole(playwright.AriaRole(c.Role), playwright.PageGetByRoleOptions{
+			Name:  c.Name,
+			Exact: playwright.Bool(c.Exact),
+		}), nil
+	case c.Text != "":
+		return page.GetByText(c.Text, playwright.PageGetByTextOptions{Exact: playwright.Bool(c.Exact)}), nil
+	case c.TestID != "":
+		return page.GetByTestId(c.TestID), nil
+	default:
+		return nil, fmt.Errorf("候选选择器为空")
+	}
+}
+
+// ResilientLocator walks Candidates in order until one becomes visible,
+// retrying the whole chain with exponential backoff, and optionally
+// reloading the page between rounds for transient networkidle timeouts.
+type ResilientLocator struct {
+	Page       playwright.Page
+	Candidates []Candidate
+
+	// Retries is how many extra rounds to attempt after the first pass
+	// through Candidates. Defaults to 3. Ignored when MaxElapsed is set.
+	Retries int
+	// BaseDelay is the backoff delay before the first retry round,
+	// doubled after every round. Defaults to 1s. Ignored when
+	// MaxElapsed is set, since that mode retries immediately.
+	BaseDelay time.Duration
+	// Timeout bounds how long a single candidate is given to appear.
+	// Defaults to 10s.
+	Timeout time.Duration
+	// MaxElapsed, when set, bounds total wall-clock time instead of a
+	// fixed retry count, retrying immediately (no backoff) until it
+	// elapses. Mirrors the reload loop that used to be hardcoded in
+	// loginSonarqube.
+	MaxElapsed time.Duration
+	// ReloadOnTimeout reloads the page before retrying when a round
+	// finds no matching candidate.
+	ReloadOnTimeout bool
+}
+
+// WaitFor resolves the first candidate that becomes visible, retrying
+// with backoff (and, if configured, a page reload) until one does.
+func (r ResilientLocator) WaitFor(ctx context.Context) (playwright.Locator, error) {
+	log := logger.LoggerFromContext(ctx)
+
+	delay := r.BaseDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	retries := r.Retries
+	if retries <= 0 && r.MaxElapsed <= 0 {
+		retries = 3
+	}
+
+	start := time.Now()
+	var lastErr error
+
+	for attempt := 0; ; attempt++ {
+		for _, c := range r.Candidates {
+			loc, err := c.resolve(r.Page)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if err := loc.WaitFor(playwright.LocatorWaitForOptions{
+				State:   playwright.WaitForSelectorStateVisible,
+				Timeout: playwright.Float(float64(timeout.Milliseconds())),
+			}); err != nil {
+				lastErr = err
+				continue
+			}
+			return loc, nil
+		}
+
+		if r.MaxElapsed > 0 {
+			if time.Since(start) >= r.MaxElapsed {
+				break
+			}
+		} else if attempt >= retries {
+			break
+		}
+
+		log.Info("候选选择器均未出现，重试中", zap.Int("attempt", attempt+1))
+		if r.ReloadOnTimeout {
+			if _, err := r.Page.Reload(); err != nil {
+				return nil, fmt.Errorf("重新加载页面失败: %v", err)
+			}
+			if err := r.Page.WaitForLoadState(playwright.PageWaitForLoadStateOptions{
+				State: playwright.LoadStateNetworkidle,
+			}); err != nil {
+				lastErr = err
+			}
+		}
+
+		if r.MaxElapsed <= 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+
+	return nil, fmt.Errorf("等待候选选择器超时: %v", lastErr)
+}
+
+// Peek checks, without waiting or retrying, whether any Candidate is
+// already visible, returning the first one that is. Use this for a
+// cheap branch check (e.g. detecting which of two possible pages is
+// currently showing) where WaitFor's retry/backoff would block for no
+// reason on the common path where the candidates are simply absent.
+func (r ResilientLocator) Peek() (playwright.Locator, bool, error) {
+	for _, c := range r.Candidates {
+		loc, err := c.resolve(r.Page)
+		if err != nil {
+			continue
+		}
+		visible, err := loc.IsVisible()
+		if err != nil {
+			return nil, false, err
+		}
+		if visible {
+			return loc, true, nil
+		}
+	}
+	return nil, false, nil
+}
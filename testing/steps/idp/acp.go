@@ -0,0 +1,137 @@
+package idp
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/AlaudaDevops/bdd/logger"
+	"github.com/playwright-community/playwright-go"
+
+	"github.com/AlaudaDevops/sonarqube-community-build/pkg/locator"
+)
+
+// ACP drives the Alauda ACP login form: an optional
+// third-party-connectors page that must be switched to local login,
+// followed by a username/password form. Every selector up to the submit
+// button is resolved through a locator.ResilientLocator chain so a UI tweak or a
+// localized button label (e.g. 登录 vs Login vs Sign in) can be fixed
+// via YAML instead of a code change.
+type ACP struct {
+	// ConnectorsChain overrides the default chain used to detect the
+	// third-party-connectors page.
+	ConnectorsChain []locator.Candidate `yaml:"connectorsChain"`
+	// SwitchToLocalChain overrides the default chain for the button
+	// that switches from third-party to local login.
+	SwitchToLocalChain []locator.Candidate `yaml:"switchToLocalChain"`
+	// LoginFormChain overrides the default chain for the local login
+	// form's presence check.
+	LoginFormChain []locator.Candidate `yaml:"loginFormChain"`
+	// UsernameChain and PasswordChain override the default chains for
+	// the login form's input fields.
+	UsernameChain []locator.Candidate `yaml:"usernameChain"`
+	PasswordChain []locator.Candidate `yaml:"passwordChain"`
+	// SubmitButtonChain overrides the default submit-button candidate
+	// chain (登录 / Login).
+	SubmitButtonChain []locator.Candidate `yaml:"submitButtonChain"`
+}
+
+func withDefault(chain []locator.Candidate, fallback ...locator.Candidate) []locator.Candidate {
+	if len(chain) > 0 {
+		return chain
+	}
+	return fallback
+}
+
+// Login implements Strategy.
+func (a ACP) Login(ctx context.Context, page playwright.Page, creds Credentials) error {
+	log := logger.LoggerFromContext(ctx)
+
+	log.Info("正在登录 acp...")
+
+	if _, err := page.Goto(creds.BaseURL); err != nil {
+		return fmt.Errorf("导航到登录页面失败: %v", err)
+	}
+
+	if err := page.WaitForLoadState(playwright.PageWaitForLoadStateOptions{
+		State: playwright.LoadStateNetworkidle,
+	}); err != nil {
+		return err
+	}
+
+	log.Info("检查是否处于第三方登录页面...")
+	_, onConnectorsPage, err := (locator.ResilientLocator{
+		Page:       page,
+		Candidates: withDefault(a.ConnectorsChain, locator.Candidate{CSS: ".connectors"}),
+	}).Peek()
+	if err != nil {
+		return fmt.Errorf("检查第三方登录页面失败: %v", err)
+	}
+
+	if onConnectorsPage {
+		log.Info("当前在第三方登录页面，切换到本地登录...")
+		switchButton, err := locator.ResilientLocator{
+			Page: page,
+			Candidates: withDefault(a.SwitchToLocalChain,
+				locator.Candidate{Role: "button", Name: "切换本地用户登录"}),
+		}.WaitFor(ctx)
+		if err != nil {
+			return fmt.Errorf("等待切换本地用户登录按钮失败: %v", err)
+		}
+		if err := switchButton.Click(); err != nil {
+			return fmt.Errorf("点击切换本地用户登录按钮失败: %v", err)
+		}
+	} else {
+		log.Info("已是本地用户登录页")
+	}
+
+	if _, err := (locator.ResilientLocator{
+		Page:       page,
+		Candidates: withDefault(a.LoginFormChain, locator.Candidate{CSS: ".login-form"}),
+	}).WaitFor(ctx); err != nil {
+		return fmt.Errorf("等待登录表单: %v", err)
+	}
+
+	username, err := locator.ResilientLocator{
+		Page:       page,
+		Candidates: withDefault(a.UsernameChain, locator.Candidate{CSS: `input[name="username"]`}),
+	}.WaitFor(ctx)
+	if err != nil {
+		return fmt.Errorf("等待用户名输入框失败: %v", err)
+	}
+	if err := username.Fill(creds.Username); err != nil {
+		return fmt.Errorf("填写用户名失败: %v", err)
+	}
+
+	password, err := locator.ResilientLocator{
+		Page:       page,
+		Candidates: withDefault(a.PasswordChain, locator.Candidate{CSS: `input[name="password"]`}),
+	}.WaitFor(ctx)
+	if err != nil {
+		return fmt.Errorf("等待密码输入框失败: %v", err)
+	}
+	if err := password.Fill(creds.Password); err != nil {
+		return fmt.Errorf("填写密码失败: %v", err)
+	}
+
+	submit, err := locator.ResilientLocator{
+		Page: page,
+		Candidates: withDefault(a.SubmitButtonChain,
+			locator.Candidate{Role: "button", Name: "登录", Exact: true},
+			locator.Candidate{Role: "button", Name: "Login", Exact: true},
+		),
+	}.WaitFor(ctx)
+	if err != nil {
+		return fmt.Errorf("等待登录按钮失败: %v", err)
+	}
+	if err := submit.Click(); err != nil {
+		return fmt.Errorf("点击登录按钮失败: %v", err)
+	}
+
+	// 等待页头中的登录用户名出现（固定 XPath，不经候选链）
+	if err := page.Locator(fmt.Sprintf("//acl-page-header//div[text()='%v']", creds.Username)).WaitFor(); err != nil {
+		return fmt.Errorf("等待 登录用户 文本出现失败: %v", err)
+	}
+
+	log.Info("acp 登录成功...")
+	return nil
+}
@@ -0,0 +1,66 @@
+package idp
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/AlaudaDevops/bdd/logger"
+	"github.com/playwright-community/playwright-go"
+)
+
+// SelectorSetConfig configures the generic SelectorSet strategy entirely
+// from YAML, so an IdP without a purpose-built driver (Keycloak, Dex,
+// Azure AD, GitHub OAuth, generic SAML, ...) can be onboarded without
+// recompiling.
+type SelectorSetConfig struct {
+	UsernameSelector string `yaml:"usernameSelector"`
+	PasswordSelector string `yaml:"passwordSelector"`
+	SubmitSelector   string `yaml:"submitSelector"`
+	SuccessSelector  string `yaml:"successSelector"`
+}
+
+// SelectorSet logs in by filling a username/password selector pair,
+// clicking a submit selector and waiting for a success-indicator
+// selector to appear.
+type SelectorSet struct {
+	SelectorSetConfig
+}
+
+// Login implements Strategy.
+func (s SelectorSet) Login(ctx context.Context, page playwright.Page, creds Credentials) error {
+	log := logger.LoggerFromContext(ctx)
+
+	log.Info("正在使用 SelectorSet 策略登录...")
+
+	if _, err := page.Goto(creds.BaseURL); err != nil {
+		return fmt.Errorf("导航到登录页面失败: %v", err)
+	}
+
+	if err := page.WaitForLoadState(playwright.PageWaitForLoadStateOptions{
+		State: playwright.LoadStateNetworkidle,
+	}); err != nil {
+		return err
+	}
+
+	if err := page.Locator(s.UsernameSelector).Fill(creds.Username); err != nil {
+		return fmt.Errorf("填写用户名失败: %v", err)
+	}
+
+	if err := page.Locator(s.PasswordSelector).Fill(creds.Password); err != nil {
+		return fmt.Errorf("填写密码失败: %v", err)
+	}
+
+	if err := page.Locator(s.SubmitSelector).Click(); err != nil {
+		return fmt.Errorf("点击登录按钮失败: %v", err)
+	}
+
+	if err := page.Locator(s.SuccessSelector).WaitFor(playwright.LocatorWaitForOptions{
+		State:   playwright.WaitForSelectorStateVisible,
+		Timeout: playwright.Float(60000),
+	}); err != nil {
+		return fmt.Errorf("等待登录成功标志失败: %v", err)
+	}
+
+	log.Info("SelectorSet 策略登录成功...")
+	return nil
+}
@@ -0,0 +1,47 @@
+// Package idp drives the identity-provider side of an SSO login behind
+// a common Strategy interface, so SonarQube's OIDC login can be
+// verified against IdPs other than the hardcoded ACP form.
+package idp
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/playwright-community/playwright-go"
+)
+
+// Credentials carries what a Strategy needs to authenticate: the IdP's
+// login page and the account to log in with.
+type Credentials struct {
+	BaseURL  string
+	Username string
+	Password string
+}
+
+// Strategy drives one identity provider's login UI, leaving the page
+// authenticated against that IdP so a subsequent SonarQube OIDC
+// redirect succeeds without another prompt.
+type Strategy interface {
+	Login(ctx context.Context, page playwright.Page, creds Credentials) error
+}
+
+// New resolves idpType to a Strategy. idpType defaults to "acp" when
+// empty, in which case acpConfig overrides ACP's default candidate
+// chains when set. selectorSet is required when idpType is
+// "selectorSet".
+func New(idpType string, selectorSet *SelectorSetConfig, acpConfig *ACP) (Strategy, error) {
+	switch idpType {
+	case "", "acp":
+		if acpConfig != nil {
+			return *acpConfig, nil
+		}
+		return ACP{}, nil
+	case "selectorSet":
+		if selectorSet == nil {
+			return nil, fmt.Errorf("idpType 为 selectorSet 时必须提供 selectorSet 配置")
+		}
+		return SelectorSet{SelectorSetConfig: *selectorSet}, nil
+	default:
+		return nil, fmt.Errorf("不支持的 idpType: %s", idpType)
+	}
+}
@@ -2,8 +2,13 @@ package steps
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -12,8 +17,17 @@ import (
 	"github.com/cucumber/godog"
 	"github.com/playwright-community/playwright-go"
 	"go.uber.org/zap"
+
+	"github.com/AlaudaDevops/sonarqube-community-build/pkg/browser"
+	"github.com/AlaudaDevops/sonarqube-community-build/pkg/locator"
+	"github.com/AlaudaDevops/sonarqube-community-build/testing/steps/idp"
 )
 
+// maxParallelCombos bounds how many (browser, device) combinations a
+// single step drives at once, so a wide matrix doesn't spawn unbounded
+// browser contexts at the same time.
+const maxParallelCombos = 4
+
 type ssoParams struct {
 	ACPBaseURL  string        `yaml:"acpURL"`
 	ACPUser     string        `yaml:"acpUser"`
@@ -21,6 +35,34 @@ type ssoParams struct {
 	SonarURL    string        `yaml:"sonarURL"`
 	Timeout     time.Duration `yaml:"timeout"`
 	Headless    bool          `yaml:"headless"`
+	// Tag selects which shared browser session/cookie jar this scenario
+	// reuses. Scenarios sharing a tag skip the login flow once the first
+	// one has authenticated, until the session's cookie TTL expires.
+	Tag string `yaml:"tag"`
+	// Browsers lists the engines to verify SSO against, e.g.
+	// [chromium, firefox, webkit]. Defaults to [chromium].
+	Browsers []string `yaml:"browsers"`
+	// Devices lists playwright-go device names (e.g. "iPhone 13") to
+	// emulate. The step runs every Browsers x Devices combination.
+	// Defaults to a single run with no device emulation.
+	Devices    []string `yaml:"devices"`
+	Locale     string   `yaml:"locale"`
+	TimezoneID string   `yaml:"timezoneId"`
+	// IdPType selects the login strategy driven against ACPBaseURL:
+	// "acp" (default) drives the hardcoded ACP form, "selectorSet"
+	// drives the generic SelectorSet strategy configured below.
+	IdPType string `yaml:"idpType"`
+	// SelectorSet configures the generic SelectorSet strategy when
+	// IdPType is "selectorSet".
+	SelectorSet *idp.SelectorSetConfig `yaml:"selectorSet"`
+	// ACPConfig overrides the ACP strategy's default candidate chains
+	// when IdPType is "acp" (or unset), so a UI tweak or a localized
+	// button label doesn't require a code change.
+	ACPConfig *idp.ACP `yaml:"acpConfig"`
+	// OAuthProvidersChain overrides the default candidate chain used to
+	// find SonarQube's "Log in with OpenID Connect" button, so a UI
+	// tweak or a relabeled button doesn't require a code change.
+	OAuthProvidersChain []locator.Candidate `yaml:"oauthProvidersChain"`
 }
 
 func checkSSo(ctx context.Context, params *godog.DocString) (ctx2 context.Context, err error) {
@@ -38,156 +80,198 @@ func process(ctx context.Context, ssoParams ssoParams) (ctx2 context.Context, er
 	if ssoParams.Timeout == 0 {
 		ssoParams.Timeout = 10 * time.Minute
 	}
-
-	// 安装 playwright
-	if err := playwright.Install(&playwright.RunOptions{
-		Browsers: []string{"chromium"},
-	}); err != nil {
-		log.Error("安装 playwright 失败", zap.Error(err))
-		return ctx, err
-	}
-
-	// 初始化 playwright
-	pw, err := playwright.Run()
-	if err != nil {
-		log.Error("无法启动 playwright", zap.Error(err))
-		return ctx, err
+	if ssoParams.Tag == "" {
+		ssoParams.Tag = "default"
 	}
-	defer pw.Stop()
 
-	// 启动浏览器
-	browser, err := pw.Chromium.Launch(playwright.BrowserTypeLaunchOptions{
-		Headless: playwright.Bool(ssoParams.Headless),
-		Args:     []string{"--ignore-certificate-errors"},
-	})
-	if err != nil {
-		log.Error("无法启动浏览器", zap.Error(err))
-		return ctx, err
+	if sharedSession == nil {
+		return ctx, fmt.Errorf("共享浏览器会话尚未初始化")
 	}
-	defer browser.Close()
 
-	// 创建新的上下文
-	browserCtx, err := browser.NewContext(playwright.BrowserNewContextOptions{
-		IgnoreHttpsErrors: playwright.Bool(true),
-	})
-	if err != nil {
-		log.Error("创建浏览器上下文失败", zap.Error(err))
-		return ctx, err
+	engines := ssoParams.Browsers
+	if len(engines) == 0 {
+		engines = []string{"chromium"}
 	}
-	defer browserCtx.Close()
-
-	// 创建新的页面
-	page, err := browserCtx.NewPage()
-	if err != nil {
-		log.Error("创建新页面失败: %v", zap.Error(err))
-		return ctx, err
+	devices := ssoParams.Devices
+	if len(devices) == 0 {
+		devices = []string{""}
 	}
 
-	screenshotPath := "output/images/sonarqube-sso-screenshot.png"
-	defer func() {
-		data, screenshotErr := page.Screenshot(playwright.PageScreenshotOptions{
-			Path: playwright.String(screenshotPath),
-		})
-		if screenshotErr != nil {
-			log.Error("截图失败", zap.Error(screenshotErr))
-		} else {
-			ctx2 = godog.Attach(ctx2, godog.Attachment{
-				Body:      data,
-				FileName:  "sonarqube-sso-screenshot.png",
-				MediaType: "image/png",
-			})
-			log.Info("保存截图成功", zap.String("path", screenshotPath))
+	type combo struct{ engine, device string }
+	var combos []combo
+	for _, engine := range engines {
+		for _, device := range devices {
+			combos = append(combos, combo{engine, device})
 		}
-	}()
-
-	// 执行登录流程
-	if err := loginACP(ctx, page, ssoParams); err != nil {
-		log.Error("ACP 登录失败", zap.Error(err))
-		return ctx, err
 	}
 
-	if err := loginSonarqube(ctx, page, ssoParams); err != nil {
-		log.Error("Sonarqube 登录失败: ", zap.Error(err))
-		return ctx, err
+	sem := make(chan struct{}, maxParallelCombos)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	ctx2 = ctx
+
+	for _, c := range combos {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(c combo) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			attachments, runErr := runCombo(ctx, ssoParams, c.engine, c.device)
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, a := range attachments {
+				ctx2 = godog.Attach(ctx2, a)
+			}
+			if runErr != nil {
+				log.Error("SSO 校验失败", zap.String("browser", c.engine), zap.String("device", c.device), zap.Error(runErr))
+				errs = append(errs, fmt.Errorf("%s/%s: %w", c.engine, c.device, runErr))
+			}
+		}(c)
 	}
+	wg.Wait()
 
-	// 成功截图
-	return ctx, nil
+	if len(errs) > 0 {
+		return ctx2, errors.Join(errs...)
+	}
+	return ctx2, nil
 }
 
-func loginACP(ctx context.Context, page playwright.Page, params ssoParams) error {
+// runCombo drives the full SSO login sequence once, against a single
+// (engine, device) combination. It always captures a Playwright trace
+// and (when the session has video recording enabled) a video, and on
+// failure additionally dumps the page's console logs, uncaught page
+// errors and final DOM snapshot, all attached for process to report.
+func runCombo(ctx context.Context, params ssoParams, engine, device string) (attachments []godog.Attachment, err error) {
 	log := logger.LoggerFromContext(ctx)
 
-	log.Info("正在登录 acp...")
+	key := browser.ContextKey{
+		Tag:        params.Tag,
+		Engine:     engine,
+		Device:     device,
+		Locale:     params.Locale,
+		TimezoneID: params.TimezoneID,
+	}
 
-	if _, err := page.Goto(params.ACPBaseURL); err != nil {
-		return fmt.Errorf("导航到登录页面失败: %v", err)
+	page, authenticated, err := sharedSession.Page(ctx, key, false)
+	if err != nil {
+		log.Error("获取浏览器页面失败", zap.String("browser", engine), zap.String("device", device), zap.Error(err))
+		return nil, err
 	}
 
-	// 等待页面加载完成
-	if err := page.WaitForLoadState(playwright.PageWaitForLoadStateOptions{
-		State: playwright.LoadStateNetworkidle,
-	}); err != nil {
-		return err
+	deviceLabel := device
+	if deviceLabel == "" {
+		deviceLabel = "default"
 	}
+	comboLabel := fmt.Sprintf("%s-%s", engine, deviceLabel)
 
-	log.Info("等待登录表单出现...")
-	// 检查是否在第三方登录页面
-	buttonLocator := page.Locator(".connectors")
-	isVisible, err := buttonLocator.IsVisible()
-	if err != nil {
-		return fmt.Errorf("检查第三方登录页面失败: %v", err)
+	if traceErr := sharedSession.StartTraceChunk(key); traceErr != nil {
+		log.Error("启动 Tracing 分段失败", zap.Error(traceErr))
 	}
 
-	if isVisible {
-		log.Info("当前在第三方登录页面，切换到本地登录...")
-		if err := page.GetByRole("button", playwright.PageGetByRoleOptions{
-			Name: "切换本地用户登录",
-		}).Click(); err != nil {
-			return fmt.Errorf("点击切换本地用户登录按钮失败: %v", err)
-		}
-	} else {
-		log.Info("已是本地用户登录页")
+	defer func() {
+		attachments = append(attachments, captureDiagnostics(ctx, key, page, comboLabel, err != nil)...)
+	}()
+
+	if authenticated {
+		log.Info("复用已登录的浏览器会话，跳过登录流程", zap.String("browser", engine), zap.String("device", deviceLabel))
+		return nil, nil
 	}
 
-	if _, err := page.WaitForSelector(".login-form", playwright.PageWaitForSelectorOptions{
-		State:   playwright.WaitForSelectorStateVisible,
-		Timeout: playwright.Float(60000),
+	// 执行登录流程
+	strategy, err := idp.New(params.IdPType, params.SelectorSet, params.ACPConfig)
+	if err != nil {
+		log.Error("构建登录策略失败", zap.Error(err))
+		return nil, err
+	}
+
+	if err := strategy.Login(ctx, page, idp.Credentials{
+		BaseURL:  params.ACPBaseURL,
+		Username: params.ACPUser,
+		Password: params.ACPPassword,
 	}); err != nil {
-		return fmt.Errorf("等待登录表单: %v", err)
+		log.Error("IdP 登录失败", zap.Error(err))
+		return nil, err
 	}
 
-	// 填写登录表单
-	if err := page.Locator("input[name=\"username\"]").Fill(params.ACPUser); err != nil {
-		return fmt.Errorf("填写用户名失败: %v", err)
+	if err := loginSonarqube(ctx, page, params); err != nil {
+		log.Error("Sonarqube 登录失败: ", zap.Error(err))
+		return nil, err
+	}
+
+	if err := sharedSession.MarkAuthenticated(key); err != nil {
+		log.Error("保存登录状态失败", zap.Error(err))
 	}
 
-	if err := page.Locator("input[name=\"password\"]").Fill(params.ACPPassword); err != nil {
-		return fmt.Errorf("填写密码失败: %v", err)
+	return nil, nil
+}
+
+// captureDiagnostics stops key's current Tracing chunk and collects a
+// trace, a video (when the session has video recording enabled) and,
+// only when failed is true, the page's accumulated console logs,
+// uncaught page errors and a final DOM snapshot. Shared by every step
+// that drives a page through sharedSession, so every one of them
+// reports the same diagnostics on failure.
+func captureDiagnostics(ctx context.Context, key browser.ContextKey, page playwright.Page, label string, failed bool) []godog.Attachment {
+	log := logger.LoggerFromContext(ctx)
+
+	var attachments []godog.Attachment
+
+	tracePath := filepath.Join(sharedSession.TraceDir(), fmt.Sprintf("sonarqube-sso-%s.zip", label))
+	if traceErr := sharedSession.StopTraceChunk(key, tracePath); traceErr != nil {
+		log.Error("保存 Tracing 失败", zap.Error(traceErr))
+	} else if data, readErr := os.ReadFile(tracePath); readErr == nil {
+		attachments = append(attachments, godog.Attachment{
+			Body:      data,
+			FileName:  filepath.Base(tracePath),
+			MediaType: "application/zip",
+		})
 	}
 
-	// 点击登录按钮
-	if err := page.GetByRole("button", playwright.PageGetByRoleOptions{
-		Name:  "登录",
-		Exact: playwright.Bool(true),
-	}).Click(); err != nil {
-		log.Info("点击 登录 按钮失败，错误信息: %v", zap.Error(err))
-		log.Info("尝试点击 Login 按钮...")
-		if err := page.GetByRole("button", playwright.PageGetByRoleOptions{
-			Name:  "Login",
-			Exact: playwright.Bool(true),
-		}).Click(); err != nil {
-			return fmt.Errorf("点击Login按钮失败: %v", err)
+	if video := page.Video(); video != nil {
+		videoPath := filepath.Join(sharedSession.VideoDir(), fmt.Sprintf("sonarqube-sso-%s.webm", label))
+		if saveErr := video.SaveAs(videoPath); saveErr != nil {
+			log.Error("保存视频失败", zap.Error(saveErr))
+		} else if data, readErr := os.ReadFile(videoPath); readErr == nil {
+			attachments = append(attachments, godog.Attachment{
+				Body:      data,
+				FileName:  filepath.Base(videoPath),
+				MediaType: "video/webm",
+			})
 		}
 	}
 
-	// 等待 Devops 文本出现
-	if err := page.Locator(fmt.Sprintf("//acl-page-header//div[text()='%v']", params.ACPUser)).WaitFor(); err != nil {
-		return fmt.Errorf("等待 登录用户 文本出现失败: %v", err)
+	if !failed {
+		return attachments
 	}
 
-	log.Info("acp 登录成功...")
-	return nil
+	if consoleLogs := sharedSession.ConsoleLogs(key); len(consoleLogs) > 0 {
+		attachments = append(attachments, godog.Attachment{
+			Body:      []byte(strings.Join(consoleLogs, "\n")),
+			FileName:  fmt.Sprintf("sonarqube-sso-%s-console.log", label),
+			MediaType: "text/plain",
+		})
+	}
+	if pageErrors := sharedSession.PageErrors(key); len(pageErrors) > 0 {
+		attachments = append(attachments, godog.Attachment{
+			Body:      []byte(strings.Join(pageErrors, "\n")),
+			FileName:  fmt.Sprintf("sonarqube-sso-%s-pageerrors.log", label),
+			MediaType: "text/plain",
+		})
+	}
+	if dom, domErr := page.Content(); domErr != nil {
+		log.Error("获取 DOM 快照失败", zap.Error(domErr))
+	} else {
+		attachments = append(attachments, godog.Attachment{
+			Body:      []byte(dom),
+			FileName:  fmt.Sprintf("sonarqube-sso-%s-dom.html", label),
+			MediaType: "text/html",
+		})
+	}
+
+	return attachments
 }
 
 func loginSonarqube(ctx context.Context, page playwright.Page, params ssoParams) error {
@@ -199,38 +283,24 @@ func loginSonarqube(ctx context.Context, page playwright.Page, params ssoParams)
 		return fmt.Errorf("导航到 Sonarqube 登录页面失败: %v", err)
 	}
 
-	found := false
-	timeout := time.After(params.Timeout)
-
-	for !found {
-		select {
-		case <-timeout:
-			return fmt.Errorf("等待 Log in with OpenID Connect 按钮超时")
-		default:
-			// 等待页面加载完成
-			if err := page.WaitForLoadState(playwright.PageWaitForLoadStateOptions{
-				State: playwright.LoadStateNetworkidle,
-			}); err != nil {
-				return err
-			}
-			// 等待登录页面元素加载
-			log.Info("等待 Log in with OpenID Connect 按钮出现...")
-			if err := page.Locator("#oauth-providers").WaitFor(playwright.LocatorWaitForOptions{
-				State:   playwright.WaitForSelectorStateVisible,
-				Timeout: playwright.Float(60000),
-			}); err == nil {
-				found = true
-				break
-			}
-
-			if _, err := page.Reload(); err != nil {
-				return err
-			}
-		}
+	log.Info("等待 Log in with OpenID Connect 按钮出现...")
+	chain := params.OAuthProvidersChain
+	if len(chain) == 0 {
+		chain = []locator.Candidate{{CSS: "#oauth-providers"}}
+	}
+	button, err := locator.ResilientLocator{
+		Page:            page,
+		Candidates:      chain,
+		Timeout:         60 * time.Second,
+		MaxElapsed:      params.Timeout,
+		ReloadOnTimeout: true,
+	}.WaitFor(ctx)
+	if err != nil {
+		return fmt.Errorf("等待 Log in with OpenID Connect 按钮超时: %v", err)
 	}
 
 	log.Info("点击 Log in with OpenID Connect 按钮...")
-	if err := page.Locator("#oauth-providers").Click(); err != nil {
+	if err := button.Click(); err != nil {
 		return fmt.Errorf("点击 Log in with OpenID Connect 按钮失败: %v", err)
 	}
 
@@ -0,0 +1,294 @@
+package steps
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/AlaudaDevops/bdd/logger"
+	"github.com/cucumber/godog"
+	"github.com/playwright-community/playwright-go"
+	"go.uber.org/zap"
+
+	"github.com/AlaudaDevops/sonarqube-community-build/pkg/browser"
+	"github.com/AlaudaDevops/sonarqube-community-build/testing/steps/idp"
+)
+
+// networkAssertionParams extends ssoParams with a declarative list of
+// assertions to run against the HTTP exchanges captured during the
+// ACP -> SonarQube OIDC handshake.
+type networkAssertionParams struct {
+	ssoParams `yaml:",inline"`
+
+	Assertions []networkAssertion `yaml:"assertions"`
+}
+
+// networkAssertion describes one check against the captured exchanges.
+// Set NoServerErrors to check every exchange; otherwise Method and
+// URLContains select which captured request/response pair the rest of
+// the fields are checked against.
+type networkAssertion struct {
+	Method           string            `yaml:"method"`
+	URLContains      string            `yaml:"urlContains"`
+	ExpectStatus     int               `yaml:"expectStatus"`
+	LocationContains string            `yaml:"locationContains"`
+	JWTClaims        map[string]string `yaml:"jwtClaims"`
+	NoServerErrors   bool              `yaml:"noServerErrors"`
+}
+
+// networkExchange is one captured HTTP request/response pair.
+type networkExchange struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+func checkSSoWithNetworkAssertions(ctx context.Context, params *godog.DocString) (ctx2 context.Context, err error) {
+	p := networkAssertionParams{}
+	if err := yaml.Unmarshal([]byte(params.Content), &p); err != nil {
+		return ctx, err
+	}
+
+	return processWithNetworkAssertions(ctx, p)
+}
+
+// processWithNetworkAssertions drives the SSO login flow like process,
+// but also records every HTTP exchange seen by the page and fails the
+// step if any declared assertion doesn't hold, attaching the captured
+// exchanges to the godog report either way.
+func processWithNetworkAssertions(ctx context.Context, params networkAssertionParams) (ctx2 context.Context, err error) {
+	log := logger.LoggerFromContext(ctx)
+
+	if params.Timeout == 0 {
+		params.Timeout = 10 * time.Minute
+	}
+	if params.Tag == "" {
+		params.Tag = "default"
+	}
+
+	if sharedSession == nil {
+		return ctx, fmt.Errorf("共享浏览器会话尚未初始化")
+	}
+
+	key := browser.ContextKey{
+		Tag:        params.Tag,
+		Locale:     params.Locale,
+		TimezoneID: params.TimezoneID,
+	}
+
+	// This step exists to assert on the OIDC handshake's network
+	// exchanges, so it always forces a fresh login: reusing an
+	// already-authenticated shared session would skip the handshake
+	// entirely and leave every assertion checking an empty capture.
+	page, _, err := sharedSession.Page(ctx, key, true)
+	if err != nil {
+		log.Error("获取浏览器页面失败", zap.Error(err))
+		return ctx, err
+	}
+
+	if traceErr := sharedSession.StartTraceChunk(key); traceErr != nil {
+		log.Error("启动 Tracing 分段失败", zap.Error(traceErr))
+	}
+
+	ctx2 = ctx
+	defer func() {
+		for _, a := range captureDiagnostics(ctx, key, page, params.Tag, err != nil) {
+			ctx2 = godog.Attach(ctx2, a)
+		}
+	}()
+
+	var mu sync.Mutex
+	var exchanges []networkExchange
+
+	defer func() {
+		mu.Lock()
+		captured := append([]networkExchange(nil), exchanges...)
+		mu.Unlock()
+
+		log.Info("已捕获 OIDC 握手网络请求", zap.Int("count", len(captured)))
+		if a := attachNetworkLog(captured); a != nil {
+			ctx2 = godog.Attach(ctx2, *a)
+		}
+	}()
+
+	page.OnResponse(func(resp playwright.Response) {
+		req := resp.Request()
+		headers, _ := resp.AllHeaders()
+		body, _ := resp.Text()
+
+		mu.Lock()
+		exchanges = append(exchanges, networkExchange{
+			Method:  req.Method(),
+			URL:     req.URL(),
+			Status:  resp.Status(),
+			Headers: headers,
+			Body:    body,
+		})
+		mu.Unlock()
+	})
+
+	strategy, err := idp.New(params.IdPType, params.SelectorSet, params.ACPConfig)
+	if err != nil {
+		log.Error("构建登录策略失败", zap.Error(err))
+		return ctx, err
+	}
+
+	if err := strategy.Login(ctx, page, idp.Credentials{
+		BaseURL:  params.ACPBaseURL,
+		Username: params.ACPUser,
+		Password: params.ACPPassword,
+	}); err != nil {
+		log.Error("IdP 登录失败", zap.Error(err))
+		return ctx, err
+	}
+
+	if err := loginSonarqube(ctx, page, params.ssoParams); err != nil {
+		log.Error("Sonarqube 登录失败: ", zap.Error(err))
+		return ctx, err
+	}
+
+	if err := sharedSession.MarkAuthenticated(key); err != nil {
+		log.Error("保存登录状态失败", zap.Error(err))
+	}
+
+	mu.Lock()
+	captured := append([]networkExchange(nil), exchanges...)
+	mu.Unlock()
+
+	if err := evaluateAssertions(captured, params.Assertions); err != nil {
+		log.Error("网络断言校验失败", zap.Error(err))
+		return ctx2, err
+	}
+
+	return ctx2, nil
+}
+
+// attachNetworkLog marshals exchanges as a JSON attachment for the godog
+// report, returning nil if marshaling fails.
+func attachNetworkLog(exchanges []networkExchange) *godog.Attachment {
+	data, err := json.MarshalIndent(exchanges, "", "  ")
+	if err != nil {
+		return nil
+	}
+
+	return &godog.Attachment{
+		Body:      data,
+		FileName:  "sonarqube-sso-network.json",
+		MediaType: "application/json",
+	}
+}
+
+// evaluateAssertions checks every declared assertion against exchanges
+// and returns a single error listing every failure found.
+func evaluateAssertions(exchanges []networkExchange, assertions []networkAssertion) error {
+	var failures []string
+
+	for _, a := range assertions {
+		if a.NoServerErrors {
+			for _, ex := range exchanges {
+				if ex.Status >= 500 {
+					failures = append(failures, fmt.Sprintf("%s %s 返回了 %d", ex.Method, ex.URL, ex.Status))
+				}
+			}
+			continue
+		}
+
+		match := findExchange(exchanges, a.Method, a.URLContains)
+		if match == nil {
+			failures = append(failures, fmt.Sprintf("未捕获到匹配的请求: method=%s urlContains=%s", a.Method, a.URLContains))
+			continue
+		}
+
+		if a.ExpectStatus != 0 && match.Status != a.ExpectStatus {
+			failures = append(failures, fmt.Sprintf("%s %s 期望状态码 %d，实际为 %d", match.Method, match.URL, a.ExpectStatus, match.Status))
+		}
+
+		if a.LocationContains != "" {
+			location := match.Headers["location"]
+			if !strings.Contains(location, a.LocationContains) {
+				failures = append(failures, fmt.Sprintf("%s %s 的 Location 头 %q 未包含 %q", match.Method, match.URL, location, a.LocationContains))
+			}
+		}
+
+		if len(a.JWTClaims) > 0 {
+			claims, err := extractJWTClaims(match.Body)
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("解析 %s %s 的 id_token 失败: %v", match.Method, match.URL, err))
+				continue
+			}
+			for claim, want := range a.JWTClaims {
+				if got := formatClaim(claims[claim]); got != want {
+					failures = append(failures, fmt.Sprintf("id_token claim %s 期望 %q，实际为 %q", claim, want, got))
+				}
+			}
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("网络断言失败:\n%s", strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+// formatClaim renders a decoded JWT claim value for comparison against
+// the configured YAML string. json.Unmarshal decodes every JSON number
+// as float64, so whole-number claims like exp/iat/auth_time are
+// formatted without scientific notation instead of going through the
+// default %v verb (which renders large timestamps as e.g. "1.7e+09").
+func formatClaim(v interface{}) string {
+	if f, ok := v.(float64); ok && f == math.Trunc(f) {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func findExchange(exchanges []networkExchange, method, urlContains string) *networkExchange {
+	for i := range exchanges {
+		ex := &exchanges[i]
+		if method != "" && !strings.EqualFold(ex.Method, method) {
+			continue
+		}
+		if urlContains != "" && !strings.Contains(ex.URL, urlContains) {
+			continue
+		}
+		return ex
+	}
+	return nil
+}
+
+// extractJWTClaims decodes the id_token carried in a JSON response body
+// (e.g. a token endpoint response) and returns its claim set.
+func extractJWTClaims(body string) (map[string]interface{}, error) {
+	var payload struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal([]byte(body), &payload); err != nil || payload.IDToken == "" {
+		return nil, fmt.Errorf("响应体中未找到 id_token")
+	}
+
+	parts := strings.Split(payload.IDToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("id_token 不是合法的 JWT")
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("解码 id_token payload 失败: %v", err)
+	}
+
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return nil, fmt.Errorf("解析 id_token payload 失败: %v", err)
+	}
+	return claims, nil
+}
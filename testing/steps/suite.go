@@ -0,0 +1,65 @@
+package steps
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/cucumber/godog"
+	"go.uber.org/zap"
+
+	"github.com/AlaudaDevops/bdd/logger"
+	"github.com/AlaudaDevops/sonarqube-community-build/pkg/browser"
+)
+
+// sharedSession is the long-lived Playwright session reused by every
+// scenario in the suite, populated by InitializeTestSuite's BeforeSuite
+// hook and torn down by its AfterSuite hook.
+var sharedSession *browser.Session
+
+// InitializeTestSuite wires the shared browser session into the godog
+// suite lifecycle so the browser engines are installed once per run and
+// each engine is launched at most once per run instead of once per
+// scenario.
+func InitializeTestSuite(ctx *godog.TestSuiteContext) {
+	ctx.BeforeSuite(func() {
+		log := logger.LoggerFromContext(context.Background())
+
+		session, err := browser.NewSession(context.Background(), browser.Config{
+			RecordVideo: true,
+			StorageDir:  os.Getenv("SSO_STORAGE_DIR"),
+			TraceDir:    os.Getenv("SSO_TRACE_DIR"),
+			VideoDir:    os.Getenv("SSO_VIDEO_DIR"),
+			CookieTTL:   cookieTTLFromEnv(),
+		})
+		if err != nil {
+			log.Error("初始化浏览器会话失败", zap.Error(err))
+			return
+		}
+		sharedSession = session
+	})
+
+	ctx.AfterSuite(func() {
+		if sharedSession == nil {
+			return
+		}
+		if err := sharedSession.Close(); err != nil {
+			logger.LoggerFromContext(context.Background()).Error("关闭浏览器会话失败", zap.Error(err))
+		}
+	})
+}
+
+// cookieTTLFromEnv parses SSO_COOKIE_TTL (a Go duration string, e.g.
+// "30m") when set, falling back to browser.Config's default otherwise.
+func cookieTTLFromEnv() time.Duration {
+	raw := os.Getenv("SSO_COOKIE_TTL")
+	if raw == "" {
+		return 0
+	}
+	ttl, err := time.ParseDuration(raw)
+	if err != nil {
+		logger.LoggerFromContext(context.Background()).Error("解析 SSO_COOKIE_TTL 失败，使用默认值", zap.String("value", raw), zap.Error(err))
+		return 0
+	}
+	return ttl
+}